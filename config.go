@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Account describes one `[account "name"]` section: an IMAP mailbox to
+// dial plus the folders to archive from it.
+type Account struct {
+	Name     string
+	Server   string
+	Username string
+	Password string
+	Folders  []string
+}
+
+// Config is the parsed form of the INI config file passed via -c/--config.
+// It replaces the single-account .env bootstrap with a section per
+// account, modeled after the getimap example's layout.
+type Config struct {
+	OutputPath string
+	Search     map[string]string
+	Accounts   []Account
+}
+
+// loadConfig reads an INI file shaped like:
+//
+//	[output]
+//	path = /backups
+//
+//	[search]
+//	since = 2024-01-01
+//
+//	[account "work"]
+//	server = imap.example.com:993
+//	user = alice@example.com
+//	password = secret
+//	folders = INBOX,Archive
+//
+// Passwords may be left blank in the file and supplied via environment
+// variables instead; see accountPassword.
+func loadConfig(filename string) (*Config, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("opening config %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	cfg := &Config{Search: make(map[string]string)}
+	var (
+		section    string
+		subsection string
+		account    *Account
+	)
+
+	flushAccount := func() {
+		if account != nil {
+			cfg.Accounts = append(cfg.Accounts, *account)
+			account = nil
+		}
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			flushAccount()
+			section, subsection = parseSectionHeader(line)
+			if section == "account" {
+				account = &Account{Name: subsection}
+			}
+			continue
+		}
+
+		key, value, ok := parseKeyValue(line)
+		if !ok {
+			return nil, fmt.Errorf("config %s: malformed line %q", filename, line)
+		}
+
+		switch section {
+		case "output":
+			if key == "path" {
+				cfg.OutputPath = value
+			}
+		case "search":
+			cfg.Search[key] = value
+		case "account":
+			if account == nil {
+				return nil, fmt.Errorf("config %s: %q outside of an [account] section", filename, key)
+			}
+			switch key {
+			case "server":
+				account.Server = value
+			case "user":
+				account.Username = value
+			case "password":
+				account.Password = value
+			case "folders":
+				account.Folders = splitAndTrim(value, ",")
+			}
+		}
+	}
+	flushAccount()
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Accounts) == 0 {
+		return nil, fmt.Errorf("config %s: no [account] sections found", filename)
+	}
+	return cfg, nil
+}
+
+// parseSectionHeader splits a header like `[account "work"]` into
+// ("account", "work"), or `[output]` into ("output", "").
+func parseSectionHeader(line string) (section, subsection string) {
+	inner := strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")
+	parts := strings.SplitN(inner, " ", 2)
+	section = strings.TrimSpace(parts[0])
+	if len(parts) == 2 {
+		subsection = strings.Trim(strings.TrimSpace(parts[1]), `"`)
+	}
+	return section, subsection
+}
+
+func parseKeyValue(line string) (key, value string, ok bool) {
+	idx := strings.Index(line, "=")
+	if idx < 0 {
+		return "", "", false
+	}
+	key = strings.TrimSpace(line[:idx])
+	value = strings.TrimSpace(line[idx+1:])
+	return key, value, true
+}
+
+func splitAndTrim(s, sep string) []string {
+	var out []string
+	for _, part := range strings.Split(s, sep) {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// accountPassword resolves an account's password, preferring the config
+// file but falling back to environment variables so secrets don't need
+// to be committed alongside the rest of the config: first
+// <ACCOUNTNAME>_IMAP_PASSWORD, then the shared IMAP_PASSWORD.
+func accountPassword(account Account) string {
+	if account.Password != "" {
+		return account.Password
+	}
+	envName := strings.ToUpper(account.Name) + "_IMAP_PASSWORD"
+	if p := os.Getenv(envName); p != "" {
+		return p
+	}
+	return os.Getenv("IMAP_PASSWORD")
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+)
+
+// dedupMode selects how a duplicate message is recorded in its second
+// (and later) location, via the --dedup flag.
+type dedupMode string
+
+const (
+	dedupOff  dedupMode = "off"
+	dedupLink dedupMode = "link"
+	dedupRef  dedupMode = "ref"
+)
+
+func parseDedupMode(s string) (dedupMode, error) {
+	switch dedupMode(s) {
+	case dedupOff, dedupLink, dedupRef:
+		return dedupMode(s), nil
+	default:
+		return dedupOff, fmt.Errorf("invalid --dedup value %q, want off, link, or ref", s)
+	}
+}
+
+// DedupRef is one (account, mailbox, uid) that resolved to a given
+// message, so the index can record every place a message was seen even
+// though only one copy was kept on disk.
+type DedupRef struct {
+	Account string `json:"account"`
+	Mailbox string `json:"mailbox"`
+	UID     uint32 `json:"uid"`
+}
+
+// DedupEntry is the canonical on-disk copy of a message plus every
+// (account, mailbox, uid) that maps to it. ready is closed once
+// CanonicalPath has been filled in; concurrent archivers reserving the
+// same key block on it instead of reading a half-written path.
+type DedupEntry struct {
+	CanonicalPath string     `json:"canonical_path"`
+	Refs          []DedupRef `json:"refs"`
+	ready         chan struct{}
+}
+
+// DedupIndex is a cross-account index of archived messages keyed by
+// Message-ID (or a content hash, for messages without one), persisted
+// at the top of the output tree so it's shared by every account.
+type DedupIndex struct {
+	path    string
+	mu      sync.Mutex
+	Entries map[string]*DedupEntry `json:"entries"`
+}
+
+func dedupIndexPath(outputPath string) string {
+	return filepath.Join(outputPath, "dedup_index.json")
+}
+
+func loadDedupIndex(outputPath string) (*DedupIndex, error) {
+	idx := &DedupIndex{path: dedupIndexPath(outputPath), Entries: make(map[string]*DedupEntry)}
+
+	data, err := os.ReadFile(idx.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return idx, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &idx.Entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range idx.Entries {
+		entry.ready = make(chan struct{})
+		close(entry.ready) // loaded from disk, so CanonicalPath is already final
+	}
+	return idx, nil
+}
+
+func (idx *DedupIndex) save() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	data, err := json.MarshalIndent(idx.Entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(idx.path, data, 0644)
+}
+
+// dedupKey identifies a message by its RFC822 Message-ID header, falling
+// back to a SHA-256 of the raw body for messages that lack one, the way
+// the goimapsync example does.
+func dedupKey(raw []byte) string {
+	if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if id := strings.TrimSpace(m.Header.Get("Message-Id")); id != "" {
+			return "msgid:" + id
+		}
+	}
+	sum := sha256.Sum256(raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// reserve records ref against key in a single locked check-and-insert, so
+// two archivers racing on the same new key can't both conclude "not
+// found" and both write a canonical copy. The first caller gets
+// isNew=true and must write the message, then call finalize with the
+// path it chose (or abandon, if the write failed). Every later caller
+// for the same key gets isNew=false and blocks until that happens; if
+// the reservation was abandoned rather than finalized, it retries as if
+// it were first instead of trusting an empty CanonicalPath.
+func (idx *DedupIndex) reserve(key string, ref DedupRef) (entry *DedupEntry, isNew bool) {
+	for {
+		idx.mu.Lock()
+		entry, found := idx.Entries[key]
+		if found {
+			entry.Refs = append(entry.Refs, ref)
+			idx.mu.Unlock()
+			<-entry.ready
+			if entry.CanonicalPath == "" {
+				continue
+			}
+			return entry, false
+		}
+
+		entry = &DedupEntry{Refs: []DedupRef{ref}, ready: make(chan struct{})}
+		idx.Entries[key] = entry
+		idx.mu.Unlock()
+		return entry, true
+	}
+}
+
+// finalize records canonicalPath on entry and unblocks any reserve call
+// that's waiting on it.
+func (idx *DedupIndex) finalize(entry *DedupEntry, canonicalPath string) {
+	idx.mu.Lock()
+	entry.CanonicalPath = canonicalPath
+	idx.mu.Unlock()
+	close(entry.ready)
+}
+
+// abandon releases a reservation that failed before it could write a
+// canonical copy: it drops entry from the index (if key still points at
+// it) and unblocks any reserve call waiting on it, so the next caller
+// for key reserves afresh instead of inheriting a half-finished entry
+// with no CanonicalPath. Without this, a write failure on a reserved-but
+// -never-finalized key would hang every other goroutine that later
+// races on the same Message-ID, forever.
+func (idx *DedupIndex) abandon(key string, entry *DedupEntry) {
+	idx.mu.Lock()
+	if idx.Entries[key] == entry {
+		delete(idx.Entries, key)
+	}
+	idx.mu.Unlock()
+	close(entry.ready)
+}
+
+// writeDedupedMaildirMessage writes msg into mailbox's Maildir, unless an
+// identical message (by Message-ID, or content hash as a fallback) was
+// already archived elsewhere, in which case it points fullPath at that
+// canonical copy per dedup instead of writing a second one.
+func writeDedupedMaildirMessage(destDir, accountName, mailbox string, msg *imap.Message, raw []byte, dedup dedupMode, dedupIndex *DedupIndex) (string, error) {
+	if dedup == dedupOff {
+		return writeMaildirMessage(destDir, mailbox, msg, raw)
+	}
+
+	key := dedupKey(raw)
+	ref := DedupRef{Account: accountName, Mailbox: mailbox, UID: msg.Uid}
+
+	entry, isNew := dedupIndex.reserve(key, ref)
+	if !isNew {
+		fullPath, err := uniqueMaildirPath(destDir, mailbox, msg)
+		if err != nil {
+			return "", err
+		}
+		if err := dedupInto(dedup, entry.CanonicalPath, fullPath); err != nil {
+			return "", err
+		}
+		if err := dedupIndex.save(); err != nil {
+			return "", err
+		}
+		return fullPath, nil
+	}
+
+	fullPath, err := writeMaildirMessage(destDir, mailbox, msg, raw)
+	if err != nil {
+		dedupIndex.abandon(key, entry)
+		return "", err
+	}
+	dedupIndex.finalize(entry, fullPath)
+	if err := dedupIndex.save(); err != nil {
+		return "", err
+	}
+	return fullPath, nil
+}
+
+// writeDedupedMboxMessage appends msg to mailbox's mbox file, unless an
+// identical message was already archived elsewhere, in which case it
+// appends a short stub recording where the canonical copy lives instead
+// of storing the body a second time. An mbox file has no addressable
+// per-message path to hardlink or .ref, so the pointer has to live
+// inside the message itself.
+func writeDedupedMboxMessage(destDir, accountName, mailbox string, msg *imap.Message, raw []byte, dedup dedupMode, dedupIndex *DedupIndex) error {
+	if dedup == dedupOff {
+		return appendMboxMessage(destDir, mailbox, msg, raw)
+	}
+
+	key := dedupKey(raw)
+	ref := DedupRef{Account: accountName, Mailbox: mailbox, UID: msg.Uid}
+
+	entry, isNew := dedupIndex.reserve(key, ref)
+	if !isNew {
+		if err := appendMboxMessage(destDir, mailbox, msg, dedupStub(entry.CanonicalPath)); err != nil {
+			return err
+		}
+		return dedupIndex.save()
+	}
+
+	if err := appendMboxMessage(destDir, mailbox, msg, raw); err != nil {
+		dedupIndex.abandon(key, entry)
+		return err
+	}
+	dedupIndex.finalize(entry, mboxPathFor(destDir, mailbox))
+	return dedupIndex.save()
+}
+
+// writeDedupedAttachments extracts msg's attachments into destDir,
+// unless an identical message was already archived elsewhere, in which
+// case it records the duplicate and skips re-extracting them.
+func writeDedupedAttachments(destDir, accountName, mailbox string, msg *imap.Message, raw []byte, dedup dedupMode, dedupIndex *DedupIndex) error {
+	if dedup == dedupOff {
+		return saveAttachments(bytes.NewReader(raw), destDir)
+	}
+
+	key := dedupKey(raw)
+	ref := DedupRef{Account: accountName, Mailbox: mailbox, UID: msg.Uid}
+
+	entry, isNew := dedupIndex.reserve(key, ref)
+	if !isNew {
+		log.Printf("UID %d: duplicate of %s, skipping attachment extraction", msg.Uid, entry.CanonicalPath)
+		return dedupIndex.save()
+	}
+
+	if err := saveAttachments(bytes.NewReader(raw), destDir); err != nil {
+		dedupIndex.abandon(key, entry)
+		return err
+	}
+	dedupIndex.finalize(entry, filepath.Join(destDir, fmt.Sprintf("%d", msg.Uid)))
+	return dedupIndex.save()
+}
+
+// dedupStub is the raw RFC822 bytes appended to an mbox file in place of
+// a duplicate message's real body.
+func dedupStub(canonicalPath string) []byte {
+	return []byte(fmt.Sprintf("X-Dedup-Canonical: %s\r\n\r\n(duplicate message, archived once at the path above)\r\n", canonicalPath))
+}
+
+// dedupInto points fullPath at canonicalPath instead of a second copy:
+// a hardlink for dedupLink, or a small "<fullPath>.ref" file naming the
+// canonical path for dedupRef.
+func dedupInto(mode dedupMode, canonicalPath, fullPath string) error {
+	switch mode {
+	case dedupLink:
+		if err := os.Link(canonicalPath, fullPath); err != nil {
+			return fmt.Errorf("linking %s to %s: %w", fullPath, canonicalPath, err)
+		}
+	case dedupRef:
+		refPath := fullPath + ".ref"
+		if err := os.WriteFile(refPath, []byte(canonicalPath+"\n"), 0644); err != nil {
+			return fmt.Errorf("writing ref %s: %w", refPath, err)
+		}
+	}
+	return nil
+}
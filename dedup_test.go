@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseDedupMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    dedupMode
+		wantErr bool
+	}{
+		{name: "off", in: "off", want: dedupOff},
+		{name: "link", in: "link", want: dedupLink},
+		{name: "ref", in: "ref", want: dedupRef},
+		{name: "invalid", in: "bogus", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDedupMode(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseDedupMode(%q) = nil error, want error", tt.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDedupMode(%q) = %v, want nil error", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseDedupMode(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupIndexReserveSecondCallBlocksUntilFinalize(t *testing.T) {
+	idx := &DedupIndex{Entries: make(map[string]*DedupEntry)}
+
+	ref1 := DedupRef{Account: "a", Mailbox: "INBOX", UID: 1}
+	entry, isNew := idx.reserve("msgid:x", ref1)
+	if !isNew {
+		t.Fatalf("first reserve: isNew = false, want true")
+	}
+
+	done := make(chan *DedupEntry, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ref2 := DedupRef{Account: "b", Mailbox: "INBOX", UID: 2}
+		second, isNew := idx.reserve("msgid:x", ref2)
+		if isNew {
+			t.Errorf("second reserve: isNew = true, want false")
+		}
+		done <- second
+	}()
+
+	idx.finalize(entry, "/archive/a/INBOX/cur/1")
+
+	second := <-done
+	if second.CanonicalPath != "/archive/a/INBOX/cur/1" {
+		t.Errorf("second reserve: CanonicalPath = %q, want %q", second.CanonicalPath, "/archive/a/INBOX/cur/1")
+	}
+	wg.Wait()
+
+	if len(idx.Entries["msgid:x"].Refs) != 2 {
+		t.Errorf("Entries[msgid:x].Refs has %d entries, want 2", len(idx.Entries["msgid:x"].Refs))
+	}
+}
+
+func TestDedupIndexAbandonUnblocksWaitersForRetry(t *testing.T) {
+	idx := &DedupIndex{Entries: make(map[string]*DedupEntry)}
+
+	ref1 := DedupRef{Account: "a", Mailbox: "INBOX", UID: 1}
+	entry, isNew := idx.reserve("msgid:x", ref1)
+	if !isNew {
+		t.Fatalf("first reserve: isNew = false, want true")
+	}
+
+	done := make(chan bool, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Simulates the write failing after a successful reserve: the
+		// second caller must not block forever on the abandoned entry's
+		// ready channel, and must get a fresh reservation of its own.
+		ref2 := DedupRef{Account: "b", Mailbox: "INBOX", UID: 2}
+		_, isNew := idx.reserve("msgid:x", ref2)
+		done <- isNew
+	}()
+
+	idx.abandon("msgid:x", entry)
+
+	select {
+	case isNew := <-done:
+		if !isNew {
+			t.Errorf("second reserve after abandon: isNew = false, want true (should retry as a fresh reservation)")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("second reserve deadlocked waiting on an abandoned entry's ready channel")
+	}
+	wg.Wait()
+}
+
+func TestDedupKey(t *testing.T) {
+	withID := []byte("Message-Id: <abc@example.com>\r\nSubject: hi\r\n\r\nbody")
+	if got := dedupKey(withID); got != "msgid:<abc@example.com>" {
+		t.Errorf("dedupKey with Message-Id = %q, want %q", got, "msgid:<abc@example.com>")
+	}
+
+	withoutID := []byte("Subject: hi\r\n\r\nbody")
+	got := dedupKey(withoutID)
+	if got == "" || got[:7] != "sha256:" {
+		t.Errorf("dedupKey without Message-Id = %q, want sha256: prefix", got)
+	}
+
+	if dedupKey(withoutID) != dedupKey(withoutID) {
+		t.Errorf("dedupKey is not deterministic for identical input")
+	}
+}
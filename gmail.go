@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// gmailCapability is the capability Gmail's IMAP server advertises for
+// its X-GM-THRID/X-GM-LABELS/X-GM-MSGID extensions.
+const gmailCapability = "X-GM-EXT-1"
+
+// Gmail-specific FETCH items, not part of the base IMAP spec.
+const (
+	fetchGmailThreadID imap.FetchItem = "X-GM-THRID"
+	fetchGmailLabels   imap.FetchItem = "X-GM-LABELS"
+)
+
+// isGmailServer reports whether c's server advertises the Gmail IMAP
+// extension, which exposes thread IDs and labels alongside the usual
+// envelope data.
+func isGmailServer(c *client.Client) bool {
+	ok, err := c.Support(gmailCapability)
+	if err != nil {
+		log.Printf("checking %s support: %v", gmailCapability, err)
+		return false
+	}
+	return ok
+}
+
+// gmailFetchItems are the extra FETCH items to request alongside the
+// usual set when the server is Gmail.
+func gmailFetchItems() []imap.FetchItem {
+	return []imap.FetchItem{fetchGmailThreadID, fetchGmailLabels}
+}
+
+// gmailThreadID extracts X-GM-THRID from msg's fetched items, if present.
+func gmailThreadID(msg *imap.Message) (string, bool) {
+	v, ok := msg.Items[fetchGmailThreadID]
+	if !ok || v == nil {
+		return "", false
+	}
+	return fmt.Sprintf("%v", v), true
+}
+
+// gmailLabels extracts X-GM-LABELS from msg's fetched items, if present.
+func gmailLabels(msg *imap.Message) []string {
+	v, ok := msg.Items[fetchGmailLabels]
+	if !ok || v == nil {
+		return nil
+	}
+	raw, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	labels := make([]string, 0, len(raw))
+	for _, l := range raw {
+		labels = append(labels, fmt.Sprintf("%v", l))
+	}
+	return labels
+}
+
+// gmailDestDir nests destDir under a thread_<thrid> subdirectory when msg
+// carries a Gmail thread ID, so a thread's messages land together
+// instead of in a flat per-message dump.
+func gmailDestDir(destDir string, msg *imap.Message) string {
+	thrid, ok := gmailThreadID(msg)
+	if !ok {
+		return destDir
+	}
+	return filepath.Join(destDir, fmt.Sprintf("thread_%s", thrid))
+}
+
+// writeGmailLabels writes msg's labels as a sidecar "<fullPath>.labels"
+// file, one label per line, next to the message it was fetched with.
+// Used for formats that store one file per message (Maildir, attachments).
+func writeGmailLabels(fullPath string, msg *imap.Message) {
+	labels := gmailLabels(msg)
+	if len(labels) == 0 {
+		return
+	}
+
+	sidecarPath := fullPath + ".labels"
+	if err := os.WriteFile(sidecarPath, []byte(strings.Join(labels, "\n")+"\n"), 0644); err != nil {
+		log.Printf("writing labels sidecar %s: %v", sidecarPath, err)
+	}
+}
+
+// injectGmailLabelsHeader prepends an X-Gmail-Labels header to raw when
+// msg carries Gmail labels. Used for mbox output, where messages share
+// one file and a sidecar can't be tied to a single message: the labels
+// travel with the message itself instead.
+func injectGmailLabelsHeader(raw []byte, msg *imap.Message) []byte {
+	labels := gmailLabels(msg)
+	if len(labels) == 0 {
+		return raw
+	}
+
+	header := fmt.Sprintf("X-Gmail-Labels: %s\r\n", strings.Join(labels, ", "))
+	return append([]byte(header), raw...)
+}
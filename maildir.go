@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// maildirFlags maps IMAP flags to the Maildir info-suffix flag letters,
+// per the Maildir spec (D, F, R, S, T).
+func maildirFlags(flags []string) string {
+	letters := ""
+	for _, f := range flags {
+		switch f {
+		case imap.SeenFlag:
+			letters += "S"
+		case imap.AnsweredFlag:
+			letters += "R"
+		case imap.FlaggedFlag:
+			letters += "F"
+		case imap.DeletedFlag:
+			letters += "T"
+		case imap.DraftFlag:
+			letters += "D"
+		}
+	}
+	return letters
+}
+
+// maildirPath maps an IMAP mailbox name (e.g. "INBOX.Subfolder") onto a
+// nested directory under destDir, with "." treated as the IMAP hierarchy
+// separator used by the account's folder naming.
+func maildirPath(destDir, mailbox string) string {
+	parts := strings.Split(mailbox, ".")
+	return filepath.Join(append([]string{destDir}, parts...)...)
+}
+
+// ensureMaildir creates the cur/new/tmp layout for mailbox under destDir
+// if it doesn't already exist.
+func ensureMaildir(destDir, mailbox string) (string, error) {
+	base := maildirPath(destDir, mailbox)
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(base, sub), os.ModePerm); err != nil {
+			return "", err
+		}
+	}
+	return base, nil
+}
+
+// uniqueMaildirPath ensures mailbox's Maildir layout exists under destDir
+// and returns the cur/ path a message would be written to, using
+// msg.Flags for the info suffix.
+func uniqueMaildirPath(destDir, mailbox string, msg *imap.Message) (string, error) {
+	base, err := ensureMaildir(destDir, mailbox)
+	if err != nil {
+		return "", err
+	}
+
+	unique := fmt.Sprintf("%d.M%dP%d.imap-file-bkp", time.Now().Unix(), msg.Uid, os.Getpid())
+	name := unique + ":2," + maildirFlags(msg.Flags)
+	return filepath.Join(base, "cur", name), nil
+}
+
+// writeMaildirMessage writes raw (the full RFC822 message) into mailbox's
+// cur/ directory, using msg.Flags for the info suffix and msg.InternalDate
+// for the file mtime, as Maildir-reading clients expect.
+func writeMaildirMessage(destDir, mailbox string, msg *imap.Message, raw []byte) (string, error) {
+	fullPath, err := uniqueMaildirPath(destDir, mailbox, msg)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(fullPath, raw, 0644); err != nil {
+		return "", err
+	}
+
+	if !msg.InternalDate.IsZero() {
+		if err := os.Chtimes(fullPath, msg.InternalDate, msg.InternalDate); err != nil {
+			log.Printf("Could not set mtime on %s: %v", fullPath, err)
+		}
+	}
+
+	log.Println("Saved message to:", fullPath)
+	return fullPath, nil
+}
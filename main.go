@@ -1,125 +1,221 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 	"github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
-	"github.com/joho/godotenv"
 	"golang.org/x/text/encoding/charmap"
 )
 
 // I won't change this, so I won't bother to load from .env
 const batchSize = 100
 
+// Archive formats selectable via the FORMAT env var.
+const (
+	formatAttachments = "attachments"
+	formatMaildir     = "maildir"
+	formatMbox        = "mbox"
+)
+
 func main() {
 
 	// Register the ISO-8859-1 charset handler
 	charset.RegisterEncoding("iso-8859-1", charmap.ISO8859_1)
 
-	// Load environment variables from .env file
-	err := godotenv.Load()
+	configPath := flag.String("config", "config.ini", "path to the accounts config file")
+	flag.StringVar(configPath, "c", "config.ini", "shorthand for -config")
+	watch := flag.Bool("watch", false, "after the initial sync, keep running and watch for new messages via IMAP IDLE")
+	dedupFlag := flag.String("dedup", string(dedupOff), "how to handle messages archived before, under a different account/mailbox: off, link, or ref")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Fatal(err)
 	}
 
-	imapServer := os.Getenv("IMAP_SERVER")
-	imapUsername := os.Getenv("IMAP_USERNAME")
-	imapPassword := os.Getenv("IMAP_PASSWORD")
-	imapFolder := os.Getenv("IMAP_FOLDER")
-	destDir := os.Getenv("DESTINATION_DIR")
-	processedUIDsFile := path.Join(destDir, "processed_uids.txt")
-
-	// Load processed UIDs
-	processedUIDs := loadProcessedUIDs(processedUIDsFile)
+	format := os.Getenv("FORMAT")
+	if format == "" {
+		format = formatAttachments
+	}
 
-	// Connect to server
-	c, err := client.DialTLS(imapServer, nil)
+	dedup, err := parseDedupMode(*dedupFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("Connected")
-
-	// Login
-	if err := c.Login(imapUsername, imapPassword); err != nil {
+	dedupIndex, err := loadDedupIndex(cfg.OutputPath)
+	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Logged in to IMAP server: %s\n", imapServer)
 
-	// Select mailbox
-	mbox, err := c.Select(imapFolder, false)
+	var wg sync.WaitGroup
+	for _, account := range cfg.Accounts {
+		wg.Add(1)
+		go func(account Account) {
+			defer wg.Done()
+			if err := syncAccount(account, cfg.OutputPath, format, cfg.Search, dedup, dedupIndex); err != nil {
+				log.Printf("[%s] sync failed: %v", account.Name, err)
+			}
+		}(account)
+	}
+	wg.Wait()
+
+	if *watch || strings.EqualFold(os.Getenv("MODE"), "watch") {
+		log.Println("Initial sync complete, entering watch mode")
+		watchAccounts(cfg, format, dedup, dedupIndex)
+	}
+}
+
+// syncAccount dials one account's server, logs in, and archives every
+// folder listed for it into its own destination subdirectory.
+func syncAccount(account Account, outputPath, format string, search map[string]string, dedup dedupMode, dedupIndex *DedupIndex) error {
+	destDir := filepath.Join(outputPath, account.Name)
+	if _, err := os.Stat(destDir); os.IsNotExist(err) {
+		os.MkdirAll(destDir, os.ModePerm)
+	}
+
+	c, err := client.DialTLS(account.Server, nil)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("dialing %s: %w", account.Server, err)
+	}
+	defer c.Logout()
+	log.Printf("[%s] Connected to %s\n", account.Name, account.Server)
+
+	if err := c.Login(account.Username, accountPassword(account)); err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+	log.Printf("[%s] Logged in as %s\n", account.Name, account.Username)
+
+	state, err := loadSyncState(destDir)
+	if err != nil {
+		return fmt.Errorf("loading sync state: %w", err)
 	}
-	log.Printf("Mailbox selected %s, total messages: %d\n", imapFolder, mbox.Messages)
+
+	isGmail := isGmailServer(c)
+	if isGmail {
+		log.Printf("[%s] Gmail server detected, preserving threads and labels\n", account.Name)
+	}
+
+	for _, folder := range account.Folders {
+		if err := syncFolder(c, account.Name, folder, destDir, format, search, state, isGmail, dedup, dedupIndex); err != nil {
+			log.Printf("[%s/%s] sync error: %v", account.Name, folder, err)
+		}
+	}
+
+	return nil
+}
+
+// syncFolder selects mailbox on c and archives only what's new since
+// the last run: if UIDVALIDITY still matches state's watermark, it asks
+// the server for UIDs above the last one processed; otherwise the
+// mailbox was renumbered and it falls back to a full rescan. Either way
+// the request is narrowed by any configured search filters.
+func syncFolder(c *client.Client, accountName, mailbox, destDir, format string, search map[string]string, state *SyncState, isGmail bool, dedup dedupMode, dedupIndex *DedupIndex) error {
+	mbox, err := c.Select(mailbox, false)
+	if err != nil {
+		return fmt.Errorf("selecting %s: %w", mailbox, err)
+	}
+	log.Printf("[%s/%s] Mailbox selected, total messages: %d\n", accountName, mailbox, mbox.Messages)
 
 	if mbox.Messages == 0 {
-		log.Println("No messages in mailbox")
-		return
+		log.Printf("[%s/%s] No messages in mailbox\n", accountName, mailbox)
+		return nil
 	}
 
-	// Create destination directory if it doesn't exist
-	if _, err := os.Stat(destDir); os.IsNotExist(err) {
-		os.Mkdir(destDir, os.ModePerm)
+	ms := state.get(mailbox)
+	startUID := ms.LastUID + 1
+	if ms.UIDValidity != 0 && ms.UIDValidity != mbox.UidValidity {
+		log.Printf("[%s/%s] UIDVALIDITY changed (%d -> %d), falling back to full rescan", accountName, mailbox, ms.UIDValidity, mbox.UidValidity)
+		startUID = 1
 	}
 
-	// Fetch messages in batches
-	for i := uint32(1); i <= mbox.Messages; i += batchSize {
-		end := i + batchSize - 1
-		if end > mbox.Messages {
-			end = mbox.Messages
+	criteria := buildSearchCriteria(search)
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(startUID, 0)
+
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return fmt.Errorf("searching %s: %w", mailbox, err)
+	}
+	if len(uids) == 0 {
+		log.Printf("[%s/%s] No new messages\n", accountName, mailbox)
+		state.update(mailbox, mbox.UidValidity, ms.LastUID)
+		return state.save()
+	}
+
+	maxUID := ms.LastUID
+	var failedUID uint32 // lowest UID that failed to process this run, 0 if none
+	for i := 0; i < len(uids); i += batchSize {
+		end := i + batchSize
+		if end > len(uids) {
+			end = len(uids)
 		}
+		batch := uids[i:end]
 
 		seqset := new(imap.SeqSet)
-		seqset.AddRange(i, end)
+		for _, uid := range batch {
+			seqset.AddNum(uid)
+		}
 
-		log.Printf("Fetching messages %d:%d\n", i, i+batchSize-1)
-		messages := make(chan *imap.Message, batchSize)
+		fetchItems := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchBodyStructure, imap.FetchFlags, imap.FetchInternalDate}
+		if isGmail {
+			fetchItems = append(fetchItems, gmailFetchItems()...)
+		}
+
+		log.Printf("[%s/%s] Fetching %d messages\n", accountName, mailbox, len(batch))
+		messages := make(chan *imap.Message, len(batch))
 		done := make(chan error, 1)
 		go func() {
-			// done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchBodyStructure}, messages)
-			done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchBodyStructure}, messages)
+			done <- c.UidFetch(seqset, fetchItems, messages)
 		}()
 
-		log.Printf("Processing %d messages\n", len(messages))
-
-		// Process each message
 		for msg := range messages {
-			if _, processed := processedUIDs[msg.Uid]; processed {
-				log.Printf("Message UID: %d already processed, skipping\n", msg.Uid)
+			log.Printf("[%s/%s] Processing message UID: %d\n", accountName, mailbox, msg.Uid)
+			if err := processMessage(c, msg, destDir, accountName, mailbox, format, isGmail, dedup, dedupIndex); err != nil {
+				log.Printf("[%s/%s] UID %d: %v", accountName, mailbox, msg.Uid, err)
+				if failedUID == 0 || msg.Uid < failedUID {
+					failedUID = msg.Uid
+				}
 				continue
 			}
-
-			log.Printf("Processing message UID: %d\n", msg.Uid)
-			processMessage(c, msg, destDir)
-			processedUIDs[msg.Uid] = struct{}{}
-			appendProcessedUID(processedUIDsFile, msg.Uid)
+			if msg.Uid > maxUID {
+				maxUID = msg.Uid
+			}
 		}
 
 		if err := <-done; err != nil {
-			log.Fatal(err)
+			return err
 		}
-		log.Println("Batch processed")
+		log.Printf("[%s/%s] Batch processed\n", accountName, mailbox)
 	}
 
-	// Logout
-	if err := c.Logout(); err != nil {
-		log.Fatal(err)
+	// Never persist a watermark past a UID that failed to process: a
+	// later UID in the same or a subsequent batch can still succeed and
+	// push maxUID beyond it, which would make the next run's UID SEARCH
+	// skip the failure forever instead of retrying it.
+	if failedUID != 0 && failedUID-1 < maxUID {
+		maxUID = failedUID - 1
 	}
-	log.Println("Logged out")
+
+	state.update(mailbox, mbox.UidValidity, maxUID)
+	return state.save()
 }
 
-func processMessage(c *client.Client, msg *imap.Message, destDir string) {
+// processMessage fetches msg's body and archives it in the configured
+// format. Errors are returned rather than fatal: a single malformed
+// message or write failure must not take down the rest of an account's
+// sync, let alone the whole multi-account process or watch daemon.
+func processMessage(c *client.Client, msg *imap.Message, destDir, accountName, mailbox, format string, isGmail bool, dedup dedupMode, dedupIndex *DedupIndex) error {
 	section := &imap.BodySectionName{}
 	seqset := new(imap.SeqSet)
 	seqset.AddNum(msg.Uid)
@@ -130,91 +226,118 @@ func processMessage(c *client.Client, msg *imap.Message, destDir string) {
 		done <- c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages)
 	}()
 
+	// Thread-dir nesting only makes sense for one-file-per-message formats
+	// (Maildir, attachments); mbox already carries thread/label data via
+	// the injected X-Gmail-Labels header, and splitting it into one
+	// fragment per thread would defeat the point of a single sequential
+	// mbox archive.
+	msgDestDir := destDir
+	if isGmail && format != formatMbox {
+		msgDestDir = gmailDestDir(destDir, msg)
+	}
+
+	var procErr error
 	for msg := range messages {
 		r := msg.GetBody(section)
 		if r == nil {
-			log.Fatal("Server didn't return message body")
-		}
-
-		mr, err := mail.CreateReader(r)
-		if err != nil {
-			log.Fatal(err)
+			procErr = fmt.Errorf("UID %d: server didn't return message body", msg.Uid)
+			continue
 		}
 
-		// Process each message's parts
-		for {
-			part, err := mr.NextPart()
+		switch format {
+		case formatMaildir, formatMbox:
+			raw, err := io.ReadAll(r)
 			if err != nil {
-				break
+				procErr = fmt.Errorf("UID %d: reading body: %w", msg.Uid, err)
+				continue
 			}
-
-			switch h := part.Header.(type) {
-			case *mail.AttachmentHeader:
-				filename, _ := h.Filename()
-				fullPath := filepath.Join(destDir, filename)
-
-				if _, err := os.Stat(fullPath); err == nil {
-					timestamp := time.Now().Format("20060102_150405")
-					fullPath = filepath.Join(destDir, fmt.Sprintf("%s_%s", timestamp, filename))
-				}
-
-				log.Println("Saving attachment to:", fullPath)
-
-				file, err := os.Create(fullPath)
+			if format == formatMaildir {
+				fullPath, err := writeDedupedMaildirMessage(msgDestDir, accountName, mailbox, msg, raw, dedup, dedupIndex)
 				if err != nil {
+					procErr = fmt.Errorf("UID %d: %w", msg.Uid, err)
 					continue
 				}
-				defer file.Close()
-
-				// write part.Body to file
-				_, err = io.Copy(file, part.Body)
+				if isGmail {
+					writeGmailLabels(fullPath, msg)
+				}
+			} else {
+				if isGmail {
+					raw = injectGmailLabelsHeader(raw, msg)
+				}
+				if err := writeDedupedMboxMessage(msgDestDir, accountName, mailbox, msg, raw, dedup, dedupIndex); err != nil {
+					procErr = fmt.Errorf("UID %d: %w", msg.Uid, err)
+					continue
+				}
+			}
+		default:
+			if dedup == dedupOff {
+				if err := saveAttachments(r, msgDestDir); err != nil {
+					procErr = fmt.Errorf("UID %d: %w", msg.Uid, err)
+					continue
+				}
+			} else {
+				raw, err := io.ReadAll(r)
 				if err != nil {
-					log.Fatal(err)
+					procErr = fmt.Errorf("UID %d: reading body: %w", msg.Uid, err)
+					continue
 				}
+				if err := writeDedupedAttachments(msgDestDir, accountName, mailbox, msg, raw, dedup, dedupIndex); err != nil {
+					procErr = fmt.Errorf("UID %d: %w", msg.Uid, err)
+					continue
+				}
+			}
+			if isGmail {
+				writeGmailLabels(filepath.Join(msgDestDir, fmt.Sprintf("%d", msg.Uid)), msg)
 			}
 		}
 	}
 
 	if err := <-done; err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return procErr
 }
 
-func loadProcessedUIDs(filename string) map[uint32]struct{} {
-	processedUIDs := make(map[uint32]struct{})
-	file, err := os.Open(filename)
+// saveAttachments preserves the original attachments-only behavior:
+// walk the message parts and write each attachment to destDir.
+func saveAttachments(r io.Reader, destDir string) error {
+	mr, err := mail.CreateReader(r)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return processedUIDs
-		}
-		log.Fatal(err)
+		return fmt.Errorf("reading message: %w", err)
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		uid, err := strconv.ParseUint(scanner.Text(), 10, 32)
+	// Process each message's parts
+	for {
+		part, err := mr.NextPart()
 		if err != nil {
-			log.Fatal(err)
+			break
 		}
-		processedUIDs[uint32(uid)] = struct{}{}
-	}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
-	}
+		switch h := part.Header.(type) {
+		case *mail.AttachmentHeader:
+			filename, _ := h.Filename()
+			fullPath := filepath.Join(destDir, filename)
 
-	return processedUIDs
-}
+			if _, err := os.Stat(fullPath); err == nil {
+				timestamp := time.Now().Format("20060102_150405")
+				fullPath = filepath.Join(destDir, fmt.Sprintf("%s_%s", timestamp, filename))
+			}
 
-func appendProcessedUID(filename string, uid uint32) {
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
+			log.Println("Saving attachment to:", fullPath)
 
-	if _, err := file.WriteString(fmt.Sprintf("%d\n", uid)); err != nil {
-		log.Fatal(err)
+			file, err := os.Create(fullPath)
+			if err != nil {
+				log.Printf("creating %s: %v", fullPath, err)
+				continue
+			}
+
+			_, err = io.Copy(file, part.Body)
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("writing %s: %w", fullPath, err)
+			}
+		}
 	}
+
+	return nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// mboxSenderFor returns the envelope From address used for the mbox
+// "From " separator line, falling back to a placeholder when the
+// envelope carries none (some servers omit it for malformed mail).
+func mboxSenderFor(msg *imap.Message) string {
+	if msg.Envelope == nil || len(msg.Envelope.From) == 0 {
+		return "MAILER-DAEMON"
+	}
+	addr := msg.Envelope.From[0]
+	return fmt.Sprintf("%s@%s", addr.MailboxName, addr.HostName)
+}
+
+// mboxEscape applies the mboxrd "From "-line quoting: any line starting
+// with zero-or-more ">" followed by "From " gets exactly one more ">"
+// prepended, so mbox readers don't mistake it for a message separator.
+func mboxEscape(raw []byte) []byte {
+	lines := bytes.Split(raw, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			line = append([]byte(">"), line...)
+		}
+		lines[i] = line
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// mboxPathFor maps an IMAP mailbox name onto a single mbox file under
+// destDir, mirroring the nesting maildirPath uses for Maildir output.
+func mboxPathFor(destDir, mailbox string) string {
+	return filepath.Join(destDir, mailbox+".mbox")
+}
+
+// appendMboxMessage appends raw (the full RFC822 message) to mailbox's
+// mbox file under destDir, using msg.InternalDate for the "From " line
+// timestamp.
+func appendMboxMessage(destDir, mailbox string, msg *imap.Message, raw []byte) error {
+	fullPath := mboxPathFor(destDir, mailbox)
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	date := msg.InternalDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	if _, err := fmt.Fprintf(file, "From %s %s\n", mboxSenderFor(msg), date.Format(time.ANSIC)); err != nil {
+		return err
+	}
+	if _, err := file.Write(mboxEscape(raw)); err != nil {
+		return err
+	}
+	if _, err := file.Write([]byte("\n\n")); err != nil {
+		return err
+	}
+
+	log.Println("Appended message to:", fullPath)
+	return nil
+}
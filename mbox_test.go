@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMboxEscape(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "plain From line gets one quote",
+			in:   "From someone\nhello",
+			want: ">From someone\nhello",
+		},
+		{
+			name: "already-quoted From line gets one more quote",
+			in:   ">From someone\nhello",
+			want: ">>From someone\nhello",
+		},
+		{
+			name: "deeply-quoted From line gets one more quote",
+			in:   ">>From someone\nhello",
+			want: ">>>From someone\nhello",
+		},
+		{
+			name: "unrelated line is untouched",
+			in:   "Forwarded: hello\nFrom someone else",
+			want: "Forwarded: hello\n>From someone else",
+		},
+		{
+			name: "no From line is untouched",
+			in:   "hello\nworld",
+			want: "hello\nworld",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mboxEscape([]byte(tt.in))
+			if !bytes.Equal(got, []byte(tt.want)) {
+				t.Errorf("mboxEscape(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
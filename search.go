@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// buildSearchCriteria turns the [search] section of the config file into
+// an IMAP SEARCH criteria, similar to the filters the lemoncrypt
+// example exposes on IMAPSource.Iterate. Recognized keys: since (date,
+// YYYY-MM-DD), from, subject, unseen (bool), not_flagged (bool).
+func buildSearchCriteria(search map[string]string) *imap.SearchCriteria {
+	criteria := imap.NewSearchCriteria()
+
+	if since, ok := search["since"]; ok {
+		t, err := time.Parse("2006-01-02", since)
+		if err != nil {
+			log.Printf("search: invalid since date %q: %v", since, err)
+		} else {
+			criteria.Since = t
+		}
+	}
+
+	if from, ok := search["from"]; ok {
+		criteria.Header.Add("From", from)
+	}
+
+	if subject, ok := search["subject"]; ok {
+		criteria.Header.Add("Subject", subject)
+	}
+
+	if unseen, ok := search["unseen"]; ok && isTruthy(unseen) {
+		criteria.WithoutFlags = append(criteria.WithoutFlags, imap.SeenFlag)
+	}
+
+	if notFlagged, ok := search["not_flagged"]; ok && isTruthy(notFlagged) {
+		criteria.WithoutFlags = append(criteria.WithoutFlags, imap.FlaggedFlag)
+	}
+
+	return criteria
+}
+
+func isTruthy(s string) bool {
+	return strings.EqualFold(s, "true") || s == "1"
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// MailboxState is the incremental-sync watermark for one mailbox: the
+// UIDVALIDITY it was last observed under and the highest UID archived
+// so far. A UIDVALIDITY change means the server has renumbered the
+// mailbox and any previous watermark is meaningless.
+type MailboxState struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	LastUID     uint32 `json:"last_uid"`
+}
+
+// SyncState is an account's per-mailbox watermarks, persisted as JSON
+// under that account's destination directory. It replaces the flat
+// processed_uids.txt: instead of recording every UID ever seen, it only
+// needs the high-water mark to ask the server for what's new. One
+// SyncState is shared by every folder watcher of an account (watch.go),
+// so update/save/get are guarded by mu rather than each folder keeping
+// and independently saving its own copy of the whole file.
+type SyncState struct {
+	path      string
+	mu        sync.Mutex
+	Mailboxes map[string]MailboxState
+}
+
+func syncStatePath(destDir string) string {
+	return filepath.Join(destDir, "sync_state.json")
+}
+
+// loadSyncState reads destDir's sync_state.json, returning an empty
+// state if it doesn't exist yet (first run).
+func loadSyncState(destDir string) (*SyncState, error) {
+	state := &SyncState{path: syncStatePath(destDir), Mailboxes: make(map[string]MailboxState)}
+
+	data, err := os.ReadFile(state.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &state.Mailboxes); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// get returns mailbox's current watermark, safe to call concurrently
+// with update/save from other folders sharing this SyncState.
+func (s *SyncState) get(mailbox string) MailboxState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Mailboxes[mailbox]
+}
+
+// update records uidValidity and the highest UID fetched for mailbox so
+// far this run.
+func (s *SyncState) update(mailbox string, uidValidity, lastUID uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur := s.Mailboxes[mailbox]
+	cur.UIDValidity = uidValidity
+	if lastUID > cur.LastUID {
+		cur.LastUID = lastUID
+	}
+	s.Mailboxes[mailbox] = cur
+}
+
+func (s *SyncState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(s.Mailboxes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0644)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSyncStateConcurrentFolders(t *testing.T) {
+	dir := t.TempDir()
+	state, err := loadSyncState(dir)
+	if err != nil {
+		t.Fatalf("loadSyncState: %v", err)
+	}
+
+	folders := []string{"INBOX", "Sent", "Archive"}
+	var wg sync.WaitGroup
+	for i, folder := range folders {
+		wg.Add(1)
+		go func(folder string, lastUID uint32) {
+			defer wg.Done()
+			state.update(folder, 1, lastUID)
+			if err := state.save(); err != nil {
+				t.Errorf("save: %v", err)
+			}
+		}(folder, uint32(i+1))
+	}
+	wg.Wait()
+
+	reloaded, err := loadSyncState(dir)
+	if err != nil {
+		t.Fatalf("loadSyncState after concurrent updates: %v", err)
+	}
+	for i, folder := range folders {
+		want := uint32(i + 1)
+		if got := reloaded.Mailboxes[folder].LastUID; got != want {
+			t.Errorf("Mailboxes[%q].LastUID = %d, want %d (a concurrent save clobbered another folder's watermark)", folder, got, want)
+		}
+	}
+}
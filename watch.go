@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	idle "github.com/emersion/go-imap-idle"
+)
+
+// idleTimeout is how long idle.Client keeps a single IDLE command open
+// before re-issuing it, set well inside the ~29-minute timeout most
+// servers enforce. It drives idle.Client.LogoutTimeout for servers that
+// support real IDLE; IdleWithFallback's own pollInterval argument only
+// matters for servers that don't, where it's used to poll instead.
+const idleTimeout = 25 * time.Minute
+
+const (
+	reconnectBaseDelay = 1 * time.Second
+	reconnectMaxDelay  = 5 * time.Minute
+)
+
+// watchAccounts keeps one IDLE connection open per account/folder,
+// running forever. Called after the initial catch-up sync when --watch
+// is set.
+func watchAccounts(cfg *Config, format string, dedup dedupMode, dedupIndex *DedupIndex) {
+	var wg sync.WaitGroup
+	for _, account := range cfg.Accounts {
+		destDir := filepath.Join(cfg.OutputPath, account.Name)
+		state, err := loadSyncState(destDir)
+		if err != nil {
+			log.Printf("[%s] loading sync state: %v", account.Name, err)
+			continue
+		}
+
+		for _, folder := range account.Folders {
+			wg.Add(1)
+			go func(account Account, folder string) {
+				defer wg.Done()
+				watchFolder(account, folder, destDir, format, cfg.Search, state, dedup, dedupIndex)
+			}(account, folder)
+		}
+	}
+	wg.Wait()
+}
+
+// watchFolder maintains a dedicated connection to account/folder,
+// reconnecting with exponential backoff whenever it drops. state is
+// shared with every other folder watcher of the same account, since
+// sync_state.json is one file per account, not per folder.
+func watchFolder(account Account, folder, destDir, format string, search map[string]string, state *SyncState, dedup dedupMode, dedupIndex *DedupIndex) {
+	delay := reconnectBaseDelay
+
+	for {
+		err := watchFolderOnce(account, folder, destDir, format, search, state, dedup, dedupIndex)
+		log.Printf("[%s/%s] watch connection ended: %v; reconnecting in %s", account.Name, folder, err, delay)
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// watchFolderOnce dials, logs in, runs one incremental sync to catch up,
+// then issues IDLE and resyncs whenever the server reports new activity.
+// It returns (never nil) once the connection is no longer usable, so the
+// caller can reconnect.
+func watchFolderOnce(account Account, folder, destDir, format string, search map[string]string, state *SyncState, dedup dedupMode, dedupIndex *DedupIndex) error {
+	c, err := client.DialTLS(account.Server, nil)
+	if err != nil {
+		return fmt.Errorf("dialing %s: %w", account.Server, err)
+	}
+	defer c.Logout()
+
+	if err := c.Login(account.Username, accountPassword(account)); err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+
+	isGmail := isGmailServer(c)
+
+	updates := make(chan client.Update, 1)
+	c.Updates = updates
+	idleClient := idle.NewClient(c)
+	idleClient.LogoutTimeout = idleTimeout
+
+	log.Printf("[%s/%s] Watching for new messages\n", account.Name, folder)
+
+	for {
+		if _, err := c.Select(folder, false); err != nil {
+			return fmt.Errorf("selecting %s: %w", folder, err)
+		}
+
+		if err := syncFolder(c, account.Name, folder, destDir, format, search, state, isGmail, dedup, dedupIndex); err != nil {
+			log.Printf("[%s/%s] sync error: %v", account.Name, folder, err)
+		}
+
+		stop := make(chan struct{})
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- idleClient.IdleWithFallback(stop, idleTimeout)
+		}()
+
+		select {
+		case update := <-updates:
+			if _, ok := update.(*client.MailboxUpdate); ok {
+				log.Printf("[%s/%s] New activity, resyncing\n", account.Name, folder)
+			}
+			close(stop)
+			if err := <-idleDone; err != nil {
+				return fmt.Errorf("idle: %w", err)
+			}
+		case err := <-idleDone:
+			// idleTimeout elapsed with no server update; loop around to
+			// re-issue IDLE after a quick resync.
+			if err != nil {
+				return fmt.Errorf("idle: %w", err)
+			}
+		}
+	}
+}